@@ -0,0 +1,95 @@
+package define
+
+// BuildOutputOption is used to parse custom build output(exported through
+// --output flag) options into structured format.
+type BuildOutputOption struct {
+	// Path to output directory or tar file.
+	Path string
+	// IsDir is set when output is a directory and caller wants to
+	// export content as a directory instead of a tar.
+	IsDir bool
+	// IsStdout is set when the output should be streamed to standard
+	// output instead of a file on disk.
+	IsStdout bool
+	// ConfidentialWorkload, when set, packages the exported content as a
+	// confidential-computing (SEV/SNP) workload image instead of a plain
+	// rootfs or tar stream. See ExportEncryptedWorkload.
+	ConfidentialWorkload *ConfidentialWorkloadOptions
+	// Encrypted, when IsDir is set and the destination filesystem
+	// supports fscrypt, provisions an fscrypt policy on the destination
+	// directory before it is populated, so that everything written to
+	// it by the untar step lands encrypted at rest.
+	Encrypted *DirEncryptionOptions
+	// Compression selects how the exported tar stream is compressed when
+	// it is written to a file or stdout (IsDir unset). One of "",
+	// "gzip", "zstd", or "zstd:chunked". Defaults to uncompressed.
+	Compression string
+	// ChunkSize is passed to the zstd:chunked writer when Compression is
+	// "zstd:chunked" (zero selects a built-in size). Each file forms a
+	// single chunk whatever its size; ChunkSize does not split file
+	// content.
+	ChunkSize int64
+}
+
+const (
+	// BuildOutputCompressionNone writes the tar stream out uncompressed.
+	BuildOutputCompressionNone = ""
+	// BuildOutputCompressionGzip gzip-compresses the tar stream.
+	BuildOutputCompressionGzip = "gzip"
+	// BuildOutputCompressionZstd zstd-compresses the tar stream.
+	BuildOutputCompressionZstd = "zstd"
+	// BuildOutputCompressionZstdChunked zstd-compresses the tar stream
+	// with a per-file chunk boundary and a trailing TOC, in the spirit
+	// of containers/storage's zstd:chunked layout, so a per-file byte
+	// range can in principle be fetched out of it independently. This is
+	// not a byte-for-byte implementation of that on-disk format.
+	BuildOutputCompressionZstdChunked = "zstd:chunked"
+)
+
+// DirEncryptionOptions configures the fscrypt policy ExportFromReader
+// provisions on a directory output before untarring into it.
+type DirEncryptionOptions struct {
+	// PolicyVersion is the fscrypt policy version to apply. Only 2 is
+	// currently supported; 0 defaults to 2.
+	PolicyVersion int
+	// KeyDescriptor, if set, is the hex-encoded v2 key identifier of a
+	// master key already added to the filesystem or session keyring out
+	// of band, reused as-is instead of generating and adding a new one.
+	KeyDescriptor string
+	// KeyringSource must be "" or "filesystem": a freshly generated
+	// master key is always added to the target filesystem's own
+	// keyring, since that is the only keyring FS_IOC_ADD_ENCRYPTION_KEY
+	// can address via the directory's file descriptor. Any other value
+	// is rejected rather than silently ignored.
+	KeyringSource string
+}
+
+// ConfidentialWorkloadOptions carries the information needed to turn the
+// exported content into a disk image suitable for a confidential (TEE)
+// virtual machine: the filesystem is built from the untarred content,
+// encrypted with LUKS2, and the resulting image is annotated so that a
+// compatible runtime (e.g. krun) can boot and attest it.
+type ConfidentialWorkloadOptions struct {
+	// TeeType selects the trusted execution environment the image is
+	// destined for, e.g. "sev" or "snp".
+	TeeType string
+	// AttestationURL is the attestation server that RegisterWorkload
+	// will hand the disk encryption passphrase and launch measurement
+	// to before the image is pushed anywhere.
+	AttestationURL string
+	// DiskEncryptionPassphrase is used to LUKS-encrypt the generated
+	// filesystem image. If empty, one is generated at random.
+	DiskEncryptionPassphrase string
+	// CPUs is the number of vCPUs the workload is expected to be
+	// launched with. It is recorded in the workload config so that the
+	// launch measurement can be reproduced for attestation.
+	CPUs int
+	// Memory is the amount of memory, in megabytes, the workload is
+	// expected to be launched with.
+	Memory int
+	// Annotations, if non-nil, is populated by ExportEncryptedWorkload
+	// with the WorkloadConfigAnnotation entry the image builder should
+	// carry on the OCI image config it builds around the exported disk
+	// image.
+	Annotations map[string]string
+}
@@ -0,0 +1,312 @@
+// Package mkcw ("make confidential workload") turns the contents of a
+// container image into a disk image that a confidential-computing capable
+// runtime (krun, in SEV/SNP mode) can boot directly: the rootfs is packaged
+// as an ext4/xfs filesystem, the filesystem is locked behind LUKS2, and a
+// small static entrypoint is embedded to unlock the volume at boot using a
+// key released by the attestation server.
+package mkcw
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// WorkloadConfigAnnotation is the OCI image config annotation under which
+// the JSON-encoded WorkloadConfig is stored.
+const WorkloadConfigAnnotation = "io.katacontainers.config.runtime.krun-workload-config"
+
+// WorkloadConfig describes the encrypted disk image embedded in a
+// confidential workload image, as consumed by the guest's entrypoint and by
+// the attestation server.
+type WorkloadConfig struct {
+	Type                 string `json:"tee_type"`
+	WorkloadID           string `json:"workload_id"`
+	CPUs                 int    `json:"cpus"`
+	Memory               int    `json:"memory"`
+	AttestationURL       string `json:"attestation_url"`
+	DiskEncryptionCipher string `json:"disk_encryption_cipher"`
+}
+
+// ArchiveOptions control how Archive builds the workload image.
+type ArchiveOptions struct {
+	// TeeType is either "sev" or "snp".
+	TeeType string
+	// AttestationURL is passed through to RegisterWorkload and recorded
+	// in the WorkloadConfig annotation.
+	AttestationURL string
+	// DiskEncryptionPassphrase is used to LUKS-format the generated
+	// filesystem. A random one is generated if this is empty.
+	DiskEncryptionPassphrase string
+	CPUs                     int
+	Memory                   int
+	// FilesystemType is "ext4" or "xfs". Defaults to "ext4".
+	FilesystemType string
+	// WorkDir is used to hold the intermediate filesystem image before
+	// it is LUKS-formatted. Defaults to os.TempDir().
+	WorkDir string
+}
+
+const defaultDiskEncryptionCipher = "aes-xts-plain64"
+
+// Archive untars the content read from tarInput into a scratch directory,
+// embeds the static attestation-unlock entrypoint, packages the result as
+// an encrypted disk image, and returns the WorkloadConfig that describes
+// it, the passphrase the image was LUKS-formatted with, and the path to
+// the resulting image file. The caller is responsible for removing the
+// returned image path, and for handing the passphrase to RegisterWorkload
+// before the image is pushed anywhere: it is not recorded anywhere else,
+// so losing it makes the image permanently unrecoverable.
+func Archive(tarInput io.Reader, untar func(io.Reader, string) error, options ArchiveOptions) (imagePath string, config WorkloadConfig, passphrase string, err error) {
+	if options.FilesystemType == "" {
+		options.FilesystemType = "ext4"
+	}
+	if options.WorkDir == "" {
+		options.WorkDir = os.TempDir()
+	}
+
+	rootfs, err := os.MkdirTemp(options.WorkDir, "buildah-mkcw-rootfs")
+	if err != nil {
+		return "", WorkloadConfig{}, "", fmt.Errorf("creating scratch directory for workload rootfs: %w", err)
+	}
+	defer os.RemoveAll(rootfs)
+
+	if err := untar(tarInput, rootfs); err != nil {
+		return "", WorkloadConfig{}, "", fmt.Errorf("unpacking workload content: %w", err)
+	}
+
+	workloadID, err := generateWorkloadID()
+	if err != nil {
+		return "", WorkloadConfig{}, "", err
+	}
+
+	config = WorkloadConfig{
+		Type:                 options.TeeType,
+		WorkloadID:           workloadID,
+		CPUs:                 options.CPUs,
+		Memory:               options.Memory,
+		AttestationURL:       options.AttestationURL,
+		DiskEncryptionCipher: defaultDiskEncryptionCipher,
+	}
+
+	if err := embedEntrypoint(rootfs, config); err != nil {
+		return "", WorkloadConfig{}, "", err
+	}
+
+	passphrase = options.DiskEncryptionPassphrase
+	if passphrase == "" {
+		passphrase, err = generatePassphrase()
+		if err != nil {
+			return "", WorkloadConfig{}, "", err
+		}
+	}
+
+	fsImage, err := makeFilesystemImage(rootfs, options.FilesystemType, options.WorkDir)
+	if err != nil {
+		return "", WorkloadConfig{}, "", err
+	}
+
+	if err := luksEncrypt(fsImage, passphrase); err != nil {
+		os.Remove(fsImage)
+		return "", WorkloadConfig{}, "", err
+	}
+
+	return fsImage, config, passphrase, nil
+}
+
+// entrypointPath is where the static unlock entrypoint is installed inside
+// the workload rootfs. The guest's initramfs runs it before switching root
+// into the rest of the filesystem.
+const entrypointPath = "/mkcw-entrypoint"
+
+// embedEntrypoint installs a small static entrypoint into rootfs that,
+// at boot, fetches the disk encryption passphrase RegisterWorkload handed
+// to config.AttestationURL (by presenting the guest's own launch
+// measurement for verification) and uses it to unlock the LUKS2 volume
+// before continuing the boot.
+func embedEntrypoint(rootfs string, config WorkloadConfig) error {
+	script := fmt.Sprintf(`#!/bin/sh
+# Static confidential-workload entrypoint for workload %s.
+# Unlocks the LUKS2-encrypted root filesystem using a passphrase released
+# by the attestation server, once it has verified this guest's launch
+# measurement.
+set -e
+passphrase=$(attestation-client fetch-passphrase --url %q --workload-id %q)
+echo "$passphrase" | cryptsetup open --type luks2 /dev/vda root-crypt -d -
+`, config.WorkloadID, config.AttestationURL, config.WorkloadID)
+
+	if err := os.WriteFile(filepath.Join(rootfs, entrypointPath), []byte(script), 0500); err != nil {
+		return fmt.Errorf("embedding confidential workload entrypoint: %w", err)
+	}
+	return nil
+}
+
+// ComputeLaunchMeasurement digests the final encrypted image file at
+// imagePath, to be passed to RegisterWorkload as the launch measurement
+// the attestation server should expect the guest to present at boot.
+func ComputeLaunchMeasurement(imagePath string) (string, error) {
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("opening workload image to measure it: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("measuring workload image: %w", err)
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
+
+// luksHeaderRoom is how much genuinely unused space makeFilesystemImage
+// leaves at the end of the image file, past what the filesystem itself
+// claims, for cryptsetup to write a LUKS2 header into via
+// --reduce-device-size. It must stay in sync with the size passed to
+// --reduce-device-size in luksEncrypt.
+const luksHeaderRoom = 16 * 1024 * 1024
+
+// makeFilesystemImage populates a fresh ext4/xfs image with the contents of
+// rootfs by shelling out to the corresponding mkfs tool, which supports
+// building a populated image directly from a source directory. The
+// filesystem itself is sized smaller than the image file by
+// luksHeaderRoom, so that cryptsetup has real free space at the end of the
+// device to carve the LUKS2 header out of afterwards; mkfs.* size the
+// filesystem to fill whatever the image file's size is at the time they
+// run, so that headroom can only be added to the file after mkfs, not
+// before.
+func makeFilesystemImage(rootfs, fsType, workDir string) (string, error) {
+	image, err := os.CreateTemp(workDir, "buildah-mkcw-image")
+	if err != nil {
+		return "", fmt.Errorf("creating filesystem image file: %w", err)
+	}
+	imagePath := image.Name()
+	image.Close()
+
+	size, err := directorySize(rootfs)
+	if err != nil {
+		os.Remove(imagePath)
+		return "", err
+	}
+	// Leave some headroom for filesystem metadata, on top of the actual
+	// content size.
+	fsSize := size + size/10
+	if err := os.Truncate(imagePath, fsSize); err != nil {
+		os.Remove(imagePath)
+		return "", fmt.Errorf("sizing filesystem image file: %w", err)
+	}
+
+	var mkfsCmd *exec.Cmd
+	switch fsType {
+	case "ext4":
+		mkfsCmd = exec.Command("mkfs.ext4", "-q", "-d", rootfs, imagePath)
+	case "xfs":
+		mkfsCmd = exec.Command("mkfs.xfs", "-q", "-d", "file="+rootfs, imagePath)
+	default:
+		os.Remove(imagePath)
+		return "", fmt.Errorf("unsupported confidential workload filesystem type %q", fsType)
+	}
+	if output, err := mkfsCmd.CombinedOutput(); err != nil {
+		os.Remove(imagePath)
+		return "", fmt.Errorf("building %s filesystem image: %w: %s", fsType, err, string(output))
+	}
+
+	// Grow the image file past what the filesystem claims, so that
+	// luksEncrypt's --reduce-device-size has untouched space to put the
+	// LUKS2 header into.
+	if err := os.Truncate(imagePath, fsSize+luksHeaderRoom); err != nil {
+		os.Remove(imagePath)
+		return "", fmt.Errorf("reserving LUKS2 header room in filesystem image file: %w", err)
+	}
+
+	return imagePath, nil
+}
+
+func directorySize(root string) (int64, error) {
+	var total int64
+	err := filepath.Walk(root, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("measuring workload content size: %w", err)
+	}
+	return total, nil
+}
+
+// luksEncrypt wraps the filesystem image in a LUKS2 container in place
+// using the provided passphrase. --reduce-device-size tells cryptsetup how
+// much space at the end of the device it may claim for the LUKS2 header;
+// makeFilesystemImage leaves exactly that much genuinely free there.
+func luksEncrypt(imagePath, passphrase string) error {
+	reduceBy := fmt.Sprintf("%dM", luksHeaderRoom/(1024*1024))
+	cmd := exec.Command("cryptsetup", "reencrypt", "--encrypt", "--type", "luks2", "--reduce-device-size", reduceBy, "--force-password", imagePath)
+	cmd.Stdin = strings.NewReader(passphrase)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("LUKS-encrypting workload filesystem image: %w: %s", err, string(output))
+	}
+	return nil
+}
+
+func generatePassphrase() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generating disk encryption passphrase: %w", err)
+	}
+	return base64.RawStdEncoding.EncodeToString(buf), nil
+}
+
+func generateWorkloadID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generating workload ID: %w", err)
+	}
+	return fmt.Sprintf("%x", buf), nil
+}
+
+// RegisterWorkload hands the disk encryption passphrase and launch
+// measurement for a workload to the attestation server named in config
+// before the resulting image is pushed anywhere, so that the server can
+// release the passphrase back to the guest once it has verified a matching
+// measurement at boot.
+func RegisterWorkload(config WorkloadConfig, passphrase, launchMeasurement string) error {
+	if config.AttestationURL == "" {
+		return fmt.Errorf("no attestation server URL configured for workload %q", config.WorkloadID)
+	}
+
+	body, err := json.Marshal(struct {
+		WorkloadID        string `json:"workload_id"`
+		Passphrase        string `json:"passphrase"`
+		LaunchMeasurement string `json:"launch_measurement"`
+	}{
+		WorkloadID:        config.WorkloadID,
+		Passphrase:        passphrase,
+		LaunchMeasurement: launchMeasurement,
+	})
+	if err != nil {
+		return fmt.Errorf("encoding attestation registration request: %w", err)
+	}
+
+	resp, err := http.Post(config.AttestationURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("registering workload with attestation server %q: %w", config.AttestationURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("attestation server %q rejected workload registration: %s", config.AttestationURL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+//go:build linux
+
+package util
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"github.com/containers/buildah/define"
+	"github.com/containers/storage/pkg/unshare"
+	"golang.org/x/sys/unix"
+)
+
+// fscryptMasterKeySize is the size, in bytes, of an fscrypt v2 raw master
+// key, per the kernel's fscrypt_add_key_arg/fscrypt_key_specifier ABI.
+const fscryptMasterKeySize = 64
+
+// fscryptKeyIdentifierSize is the size, in bytes, of an fscrypt v2 key
+// identifier, per the kernel's fscrypt_key_specifier ABI.
+const fscryptKeyIdentifierSize = 16
+
+// provisionFscryptPolicy provisions an fscrypt encryption policy on dir,
+// which must be freshly created and empty, so that everything later
+// written underneath it (by chrootarchive.Untar) is encrypted at rest.
+func provisionFscryptPolicy(dir string, opts *define.DirEncryptionOptions) error {
+	if unshare.IsRootless() {
+		return fmt.Errorf("fscrypt output encryption requires CAP_SYS_ADMIN and is not available to rootless users")
+	}
+
+	f, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("opening %q to provision fscrypt policy: %w", dir, err)
+	}
+	defer f.Close()
+
+	if err := checkFscryptSupported(f); err != nil {
+		return err
+	}
+
+	keySpec, err := addFscryptKey(f, opts)
+	if err != nil {
+		return err
+	}
+
+	return setFscryptPolicy(f, keySpec, opts)
+}
+
+// checkFscryptSupported confirms the filesystem backing f supports
+// encryption by probing FS_IOC_GET_ENCRYPTION_POLICY_EX: success or
+// ENODATA (no policy on f, but the ioctl itself is understood) counts as
+// supported; ENOTTY/EOPNOTSUPP (not supported at all) and any other errno
+// are returned as errors.
+func checkFscryptSupported(f *os.File) error {
+	var policy unix.FscryptGetPolicyExArg
+	policy.Size = uint64(unsafe.Sizeof(policy.Policy))
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.FS_IOC_GET_ENCRYPTION_POLICY_EX, uintptr(unsafe.Pointer(&policy)))
+	switch errno {
+	case 0, unix.ENODATA:
+		return nil
+	case unix.ENOTTY, unix.EOPNOTSUPP:
+		return fmt.Errorf("filesystem backing %q does not support fscrypt encryption", f.Name())
+	default:
+		return fmt.Errorf("checking fscrypt support on %q: %w", f.Name(), errno)
+	}
+}
+
+// addFscryptKey adds a master key to the filesystem keyring backing f via
+// FS_IOC_ADD_ENCRYPTION_KEY and returns the resulting key identifier. If
+// opts.KeyDescriptor is set, it is treated as the hex-encoded identifier of
+// a key the caller already added to the keyring out of band, and is used
+// as-is without generating or adding anything.
+//
+// opts.KeyringSource must be "" or "filesystem": FS_IOC_ADD_ENCRYPTION_KEY
+// always adds to the filesystem keyring of the target fd, so there is no
+// session-keyring ("user") equivalent to wire it to here. Accepting
+// "user" and silently adding to the filesystem keyring anyway would leave
+// the key reachable from a keyring the caller didn't ask for, so it is
+// rejected instead.
+func addFscryptKey(f *os.File, opts *define.DirEncryptionOptions) (unix.FscryptKeySpecifier, error) {
+	if opts.KeyringSource != "" && opts.KeyringSource != "filesystem" {
+		return unix.FscryptKeySpecifier{}, fmt.Errorf("unsupported fscrypt KeyringSource %q: only \"filesystem\" is supported", opts.KeyringSource)
+	}
+
+	if opts.KeyDescriptor != "" {
+		identifier, err := hex.DecodeString(opts.KeyDescriptor)
+		if err != nil {
+			return unix.FscryptKeySpecifier{}, fmt.Errorf("decoding fscrypt key descriptor %q: %w", opts.KeyDescriptor, err)
+		}
+		if len(identifier) != fscryptKeyIdentifierSize {
+			return unix.FscryptKeySpecifier{}, fmt.Errorf("fscrypt key descriptor %q must be %d bytes hex-encoded, got %d", opts.KeyDescriptor, fscryptKeyIdentifierSize, len(identifier))
+		}
+		var keySpec unix.FscryptKeySpecifier
+		keySpec.Type = unix.FSCRYPT_KEY_SPEC_TYPE_IDENTIFIER
+		copy(keySpec.U[:], identifier)
+		return keySpec, nil
+	}
+
+	var addArg unix.FscryptAddKeyArg
+	addArg.Key_spec.Type = unix.FSCRYPT_KEY_SPEC_TYPE_IDENTIFIER
+	addArg.Raw_size = fscryptMasterKeySize
+
+	key := make([]byte, fscryptMasterKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return unix.FscryptKeySpecifier{}, fmt.Errorf("generating fscrypt master key: %w", err)
+	}
+	copy(addArg.Raw[:], key)
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.FS_IOC_ADD_ENCRYPTION_KEY, uintptr(unsafe.Pointer(&addArg)))
+	if errno != 0 {
+		return unix.FscryptKeySpecifier{}, fmt.Errorf("adding fscrypt key to keyring: %w", errno)
+	}
+	return addArg.Key_spec, nil
+}
+
+// setFscryptPolicy applies a v2 fscrypt policy to dir keyed by keySpec via
+// FS_IOC_SET_ENCRYPTION_POLICY. Only policy version 2 is supported: v1
+// policies key off a legacy 8-byte descriptor rather than this v2 key
+// identifier and need a different kernel keyring setup entirely, which
+// current kernels and keyrings don't require in the first place.
+func setFscryptPolicy(f *os.File, keySpec unix.FscryptKeySpecifier, opts *define.DirEncryptionOptions) error {
+	version := opts.PolicyVersion
+	if version == 0 {
+		version = 2
+	}
+	if version != 2 {
+		return fmt.Errorf("unsupported fscrypt policy version %d: only version 2 is supported", version)
+	}
+
+	var policy unix.FscryptPolicyV2
+	policy.Version = unix.FSCRYPT_POLICY_V2
+	policy.Contents_encryption_mode = unix.FSCRYPT_MODE_AES_256_XTS
+	policy.Filenames_encryption_mode = unix.FSCRYPT_MODE_AES_256_CTS
+	policy.Flags = unix.FSCRYPT_POLICY_FLAGS_PAD_32
+	policy.Master_key_identifier = keySpec.U
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.FS_IOC_SET_ENCRYPTION_POLICY, uintptr(unsafe.Pointer(&policy)))
+	if errno != 0 {
+		return fmt.Errorf("setting fscrypt policy on %q: %w", f.Name(), errno)
+	}
+	return nil
+}
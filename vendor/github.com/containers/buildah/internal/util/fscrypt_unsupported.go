@@ -0,0 +1,15 @@
+//go:build !linux
+
+package util
+
+import (
+	"fmt"
+
+	"github.com/containers/buildah/define"
+)
+
+// provisionFscryptPolicy is only implemented on Linux, where the
+// FS_IOC_*_ENCRYPTION_* ioctls this relies on exist.
+func provisionFscryptPolicy(dir string, opts *define.DirEncryptionOptions) error {
+	return fmt.Errorf("fscrypt output encryption is not supported on this platform")
+}
@@ -0,0 +1,118 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// keyProviderCommand describes how to invoke a provider binary over
+// stdin/stdout with a KeyProviderKeyWrapProtocolInput/Output message, per
+// https://github.com/containers/ocicrypt/blob/main/docs/keyprovider.md
+type keyProviderCommand struct {
+	Path string   `yaml:"path"`
+	Args []string `yaml:"args"`
+}
+
+// keyProviderEntry describes a single entry of the keyprovider
+// configuration file: exactly one of Cmd or Grpc should be set.
+type keyProviderEntry struct {
+	Cmd  *keyProviderCommand `yaml:"cmd,omitempty"`
+	Grpc string              `yaml:"grpc,omitempty"`
+}
+
+// keyProviderConfig is the parsed form of the file named by
+// OCICRYPT_KEYPROVIDER_CONFIG (or --keyprovider-config): a map of provider
+// name to how to reach it. This mirrors the shape ocicrypt's own "provider"
+// key wrapper reads from the same file.
+type keyProviderConfig struct {
+	KeyProviders map[string]keyProviderEntry `yaml:"key-providers"`
+}
+
+// keyProviderConfigEnv is the standard ocicrypt environment variable used
+// to locate the keyprovider configuration file when no explicit path was
+// given; ocicrypt's own "provider" key wrapper reads it lazily at the
+// point it actually needs to invoke a provider's keywrap/keyunwrap (by
+// running the configured command over stdin/stdout with a
+// KeyProviderKeyWrapProtocolInput JSON message and parsing back a
+// KeyProviderKeyWrapProtocolOutput, or by dialing the provider's gRPC
+// endpoint and issuing the equivalent WrapKey/UnWrapKey RPC) — we don't
+// need to, and shouldn't, duplicate that dispatch here.
+const keyProviderConfigEnv = "OCICRYPT_KEYPROVIDER_CONFIG"
+
+// loadKeyProviderConfig parses the keyprovider configuration file at path.
+// If path is empty, it falls back to OCICRYPT_KEYPROVIDER_CONFIG. A missing
+// path (both argument and env) is not an error: it just means no providers
+// are configured, which is fine unless a "provider:" key is actually used.
+func loadKeyProviderConfig(path string) (*keyProviderConfig, error) {
+	if path == "" {
+		path = os.Getenv(keyProviderConfigEnv)
+	}
+	if path == "" {
+		return &keyProviderConfig{}, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading keyprovider config %q: %w", path, err)
+	}
+	var cfg keyProviderConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing keyprovider config %q: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// parseProviderKey extracts the provider name from a
+// "provider:<name>[:<attrs>]" key descriptor, reporting ok=false for any
+// other key. The attrs, if any, are not returned.
+func parseProviderKey(key string) (name string, ok bool) {
+	rest, ok := strings.CutPrefix(key, "provider:")
+	if !ok {
+		return "", false
+	}
+	name, _, _ = strings.Cut(rest, ":")
+	return name, true
+}
+
+// registerKeyProviders validates that every provider named by a
+// "provider:<name>[:<attrs>]" entry in keys is actually present in the
+// keyprovider config (so a typo or missing entry is reported against the
+// key the caller passed, not as an opaque failure deep inside ocicrypt
+// later), and, if keyProviderConfigPath was given explicitly, exports it
+// as OCICRYPT_KEYPROVIDER_CONFIG so that ocicrypt's own "provider" key
+// wrapper — which CreateCryptoConfig already wires up for "provider:" keys
+// — finds it without buildah having to reimplement its dispatch.
+func registerKeyProviders(keys []string, keyProviderConfigPath string) error {
+	var providerNames []string
+	for _, key := range keys {
+		if name, ok := parseProviderKey(key); ok {
+			providerNames = append(providerNames, name)
+		}
+	}
+	if len(providerNames) == 0 {
+		return nil
+	}
+
+	cfg, err := loadKeyProviderConfig(keyProviderConfigPath)
+	if err != nil {
+		return err
+	}
+	for _, name := range providerNames {
+		entry, ok := cfg.KeyProviders[name]
+		if !ok {
+			return fmt.Errorf("keyprovider %q referenced but not present in keyprovider config", name)
+		}
+		if entry.Cmd == nil && entry.Grpc == "" {
+			return fmt.Errorf("keyprovider %q has neither cmd nor grpc configured", name)
+		}
+	}
+
+	if keyProviderConfigPath != "" {
+		if err := os.Setenv(keyProviderConfigEnv, keyProviderConfigPath); err != nil {
+			return fmt.Errorf("setting %s: %w", keyProviderConfigEnv, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseProviderKey(t *testing.T) {
+	tests := []struct {
+		key    string
+		name   string
+		wantOK bool
+	}{
+		{"provider:attestation-agent", "attestation-agent", true},
+		{"provider:attestation-agent:some-attrs", "attestation-agent", true},
+		{"provider:", "", true},
+		{"pkcs11:/etc/key.yaml", "", false},
+		{"jwe:/etc/key.pem", "", false},
+	}
+	for _, tt := range tests {
+		name, ok := parseProviderKey(tt.key)
+		if ok != tt.wantOK || name != tt.name {
+			t.Errorf("parseProviderKey(%q) = (%q, %v), want (%q, %v)", tt.key, name, ok, tt.name, tt.wantOK)
+		}
+	}
+}
+
+func TestRegisterKeyProviders(t *testing.T) {
+	t.Run("no provider keys is a no-op", func(t *testing.T) {
+		if err := registerKeyProviders([]string{"jwe:/etc/key.pem"}, ""); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("missing config is an error", func(t *testing.T) {
+		if err := registerKeyProviders([]string{"provider:attestation-agent"}, ""); err == nil {
+			t.Error("expected an error when no keyprovider config is available, got nil")
+		}
+	})
+
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "keyprovider.yaml")
+	cfg := "key-providers:\n" +
+		"  attestation-agent:\n" +
+		"    cmd:\n" +
+		"      path: /usr/bin/attestation-agent\n" +
+		"      args: [\"--decrypt\"]\n" +
+		"  misconfigured:\n" +
+		"    grpc: \"\"\n"
+	if err := os.WriteFile(cfgPath, []byte(cfg), 0o644); err != nil {
+		t.Fatalf("writing test keyprovider config: %v", err)
+	}
+
+	t.Run("provider present in config succeeds and exports the path", func(t *testing.T) {
+		t.Setenv("OCICRYPT_KEYPROVIDER_CONFIG", "")
+		if err := registerKeyProviders([]string{"provider:attestation-agent"}, cfgPath); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if got := os.Getenv("OCICRYPT_KEYPROVIDER_CONFIG"); got != cfgPath {
+			t.Errorf("OCICRYPT_KEYPROVIDER_CONFIG = %q, want %q", got, cfgPath)
+		}
+	})
+
+	t.Run("provider missing from config is an error", func(t *testing.T) {
+		if err := registerKeyProviders([]string{"provider:does-not-exist"}, cfgPath); err == nil {
+			t.Error("expected an error for a provider not present in the config, got nil")
+		}
+	})
+
+	t.Run("provider with neither cmd nor grpc is an error", func(t *testing.T) {
+		if err := registerKeyProviders([]string{"provider:misconfigured"}, cfgPath); err == nil {
+			t.Error("expected an error for a provider with neither cmd nor grpc, got nil")
+		}
+	})
+}
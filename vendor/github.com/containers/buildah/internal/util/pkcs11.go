@@ -0,0 +1,173 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// pkcs11KeyFile is the per-key configuration referenced by a
+// "pkcs11:<path>" key descriptor: which token/object to use, and how to
+// authenticate to it. ocicrypt's own pkcs11 key wrapper uses the wrapped
+// RSA-OAEP public key on encrypt, and logs in with Pin and unwraps via
+// C_UnwrapKey/C_Decrypt on decrypt, once pointed at this file.
+type pkcs11KeyFile struct {
+	Pkcs11 struct {
+		Uri string `yaml:"pkcs11-uri"`
+		Pin string `yaml:"pkcs11-pin,omitempty"`
+	} `yaml:"pkcs11"`
+}
+
+// pkcs11Config is the process-wide PKCS#11 module configuration: which
+// directories hold PKCS#11 module (.so) files, and which specific module
+// paths are allowed to be loaded. It is parsed once per distinct path via
+// PKCS11Config and reused across image operations, since loading PKCS#11
+// modules is not free and the set of allowed modules is a host-wide policy
+// decision, not a per-key one.
+type pkcs11Config struct {
+	ModuleDirectories  []string `yaml:"module-directories"`
+	AllowedModulePaths []string `yaml:"allowed-module-paths"`
+}
+
+var (
+	pkcs11ConfigMutex sync.Mutex
+	pkcs11ConfigCache = map[string]*pkcs11Config{}
+)
+
+// PKCS11Config parses the PKCS#11 module configuration yaml at path once,
+// caching the result per path so that repeated encrypt/decrypt operations
+// against HSM-backed keys in the same process don't reparse it every time.
+func PKCS11Config(path string) (*pkcs11Config, error) {
+	pkcs11ConfigMutex.Lock()
+	defer pkcs11ConfigMutex.Unlock()
+
+	if cfg, ok := pkcs11ConfigCache[path]; ok {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading pkcs11 config %q: %w", path, err)
+	}
+	cfg := &pkcs11Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing pkcs11 config %q: %w", path, err)
+	}
+	pkcs11ConfigCache[path] = cfg
+	return cfg, nil
+}
+
+// pkcs11URIPrefix is the RFC 7512 PKCS#11 URI scheme. A "pkcs11:<...>" key
+// descriptor whose attrs begin with this, once the outer "pkcs11:" marker
+// is stripped, names a raw PKCS#11 URI rather than a yaml key file path.
+const pkcs11URIPrefix = "pkcs11:"
+
+// parsePkcs11Key splits a "pkcs11:<uri-or-yaml-path>" key descriptor into
+// the path of the pkcs11 key yaml file (or raw URI) that follows.
+func parsePkcs11Key(key string) (path string, ok bool) {
+	return strings.CutPrefix(key, "pkcs11:")
+}
+
+// loadPkcs11KeyFile reads and parses the yaml file referenced by a
+// "pkcs11:<path>" key descriptor.
+func loadPkcs11KeyFile(path string) (*pkcs11KeyFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading pkcs11 key file %q: %w", path, err)
+	}
+	keyFile := &pkcs11KeyFile{}
+	if err := yaml.Unmarshal(data, keyFile); err != nil {
+		return nil, fmt.Errorf("parsing pkcs11 key file %q: %w", path, err)
+	}
+	if keyFile.Pkcs11.Uri == "" {
+		return nil, fmt.Errorf("pkcs11 key file %q has no pkcs11-uri", path)
+	}
+	return keyFile, nil
+}
+
+// materializePkcs11URI writes a raw PKCS#11 URI (given directly as a
+// "pkcs11:pkcs11:<attrs>" key descriptor, with no PIN) out as a yaml key
+// file in os.TempDir, since ocicrypt's pkcs11 key wrapper takes a yaml
+// file path rather than a bare URI. resolvePkcs11Keys tracks the returned
+// path and removes it via the cleanup func it returns.
+func materializePkcs11URI(uri string) (string, error) {
+	keyFile := &pkcs11KeyFile{}
+	keyFile.Pkcs11.Uri = uri
+	data, err := yaml.Marshal(keyFile)
+	if err != nil {
+		return "", fmt.Errorf("encoding pkcs11 key file for %q: %w", uri, err)
+	}
+	f, err := os.CreateTemp("", "buildah-pkcs11-key-*.yaml")
+	if err != nil {
+		return "", fmt.Errorf("creating pkcs11 key file for %q: %w", uri, err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("writing pkcs11 key file for %q: %w", uri, err)
+	}
+	return f.Name(), nil
+}
+
+// resolvePkcs11Keys rewrites any "pkcs11:<uri-or-yaml-path>" entries of
+// keys into the plain yaml file path ocicrypt's own pkcs11 key wrapper
+// expects, validating along the way that the file (or, for a raw
+// "pkcs11:pkcs11:<attrs>" URI, the URI itself) names a pkcs11 URI, so that
+// configuration mistakes are reported against the actual flag/key the
+// caller passed rather than surfacing later as an opaque PKCS#11 error.
+// If pkcs11ConfigPath is non-empty and keys holds at least one pkcs11
+// entry, it is parsed via PKCS11Config up front, so an unreadable or
+// malformed config is reported here; keys are not checked against the
+// module directories or paths it lists.
+//
+// The returned cleanup func removes any temp yaml file materializePkcs11URI
+// wrote for a raw URI entry; the caller must call it once the resolved keys
+// are no longer needed, whether or not resolvePkcs11Keys itself returned an
+// error.
+func resolvePkcs11Keys(keys []string, pkcs11ConfigPath string) (resolved []string, cleanup func(), err error) {
+	var materialized []string
+	cleanup = func() {
+		for _, path := range materialized {
+			os.Remove(path)
+		}
+	}
+
+	var hasPkcs11Key bool
+	for _, key := range keys {
+		if _, ok := parsePkcs11Key(key); ok {
+			hasPkcs11Key = true
+			break
+		}
+	}
+	if hasPkcs11Key && pkcs11ConfigPath != "" {
+		if _, err := PKCS11Config(pkcs11ConfigPath); err != nil {
+			return nil, cleanup, err
+		}
+	}
+
+	resolved = make([]string, len(keys))
+	for i, key := range keys {
+		attrs, ok := parsePkcs11Key(key)
+		if !ok {
+			resolved[i] = key
+			continue
+		}
+		if strings.HasPrefix(attrs, pkcs11URIPrefix) {
+			path, err := materializePkcs11URI(attrs)
+			if err != nil {
+				return nil, cleanup, err
+			}
+			materialized = append(materialized, path)
+			resolved[i] = path
+			continue
+		}
+		if _, err := loadPkcs11KeyFile(attrs); err != nil {
+			return nil, cleanup, err
+		}
+		resolved[i] = attrs
+	}
+	return resolved, cleanup, nil
+}
@@ -0,0 +1,135 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParsePkcs11Key(t *testing.T) {
+	tests := []struct {
+		key    string
+		path   string
+		wantOK bool
+	}{
+		{"pkcs11:/etc/pkcs11-key.yaml", "/etc/pkcs11-key.yaml", true},
+		{"pkcs11:pkcs11:token=my-token;object=my-key", "pkcs11:token=my-token;object=my-key", true},
+		{"jwe:/etc/key.pem", "", false},
+		{"provider:attestation-agent", "", false},
+	}
+	for _, tt := range tests {
+		path, ok := parsePkcs11Key(tt.key)
+		if ok != tt.wantOK || path != tt.path {
+			t.Errorf("parsePkcs11Key(%q) = (%q, %v), want (%q, %v)", tt.key, path, ok, tt.path, tt.wantOK)
+		}
+	}
+}
+
+func TestResolvePkcs11Keys(t *testing.T) {
+	t.Run("non-pkcs11 keys pass through unchanged", func(t *testing.T) {
+		keys := []string{"jwe:/etc/key.pem", "provider:attestation-agent"}
+		resolved, cleanup, err := resolvePkcs11Keys(keys, "")
+		if cleanup != nil {
+			defer cleanup()
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for i := range keys {
+			if resolved[i] != keys[i] {
+				t.Errorf("resolved[%d] = %q, want %q", i, resolved[i], keys[i])
+			}
+		}
+	})
+
+	t.Run("raw pkcs11 URI is materialized into a yaml file and cleaned up", func(t *testing.T) {
+		resolved, cleanup, err := resolvePkcs11Keys([]string{"pkcs11:pkcs11:token=my-token;object=my-key"}, "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(resolved) != 1 {
+			t.Fatalf("expected 1 resolved key, got %d", len(resolved))
+		}
+		path := resolved[0]
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("expected materialized pkcs11 key file to exist: %v", err)
+		}
+		keyFile, err := loadPkcs11KeyFile(path)
+		if err != nil {
+			t.Fatalf("loading materialized pkcs11 key file: %v", err)
+		}
+		if keyFile.Pkcs11.Uri != "pkcs11:token=my-token;object=my-key" {
+			t.Errorf("materialized URI = %q, want %q", keyFile.Pkcs11.Uri, "pkcs11:token=my-token;object=my-key")
+		}
+
+		cleanup()
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected cleanup to remove %q, stat error = %v", path, err)
+		}
+	})
+
+	t.Run("pkcs11 yaml file path is validated and passed through", func(t *testing.T) {
+		dir := t.TempDir()
+		keyPath := filepath.Join(dir, "key.yaml")
+		if err := os.WriteFile(keyPath, []byte("pkcs11:\n  pkcs11-uri: \"pkcs11:token=my-token;object=my-key\"\n"), 0o644); err != nil {
+			t.Fatalf("writing test pkcs11 key file: %v", err)
+		}
+		resolved, cleanup, err := resolvePkcs11Keys([]string{"pkcs11:" + keyPath}, "")
+		if cleanup != nil {
+			defer cleanup()
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if resolved[0] != keyPath {
+			t.Errorf("resolved[0] = %q, want %q", resolved[0], keyPath)
+		}
+	})
+
+	t.Run("pkcs11 yaml file missing uri is an error", func(t *testing.T) {
+		dir := t.TempDir()
+		keyPath := filepath.Join(dir, "key.yaml")
+		if err := os.WriteFile(keyPath, []byte("pkcs11:\n  pkcs11-pin: \"1234\"\n"), 0o644); err != nil {
+			t.Fatalf("writing test pkcs11 key file: %v", err)
+		}
+		_, cleanup, err := resolvePkcs11Keys([]string{"pkcs11:" + keyPath}, "")
+		if cleanup != nil {
+			defer cleanup()
+		}
+		if err == nil {
+			t.Error("expected an error for a pkcs11 key file with no pkcs11-uri, got nil")
+		}
+	})
+}
+
+func TestPKCS11ConfigCachesPerPath(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pkcs11.yaml")
+	if err := os.WriteFile(path, []byte("module-directories:\n  - /usr/lib/pkcs11\n"), 0o644); err != nil {
+		t.Fatalf("writing test pkcs11 config: %v", err)
+	}
+
+	cfg1, err := PKCS11Config(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cfg2, err := PKCS11Config(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg1 != cfg2 {
+		t.Error("expected PKCS11Config to return the cached config for the same path")
+	}
+
+	otherPath := filepath.Join(dir, "other.yaml")
+	if err := os.WriteFile(otherPath, []byte("module-directories:\n  - /usr/lib/other-pkcs11\n"), 0o644); err != nil {
+		t.Fatalf("writing second test pkcs11 config: %v", err)
+	}
+	cfg3, err := PKCS11Config(otherPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg3 == cfg1 || len(cfg3.ModuleDirectories) != 1 || cfg3.ModuleDirectories[0] != "/usr/lib/other-pkcs11" {
+		t.Errorf("expected a distinct, correctly parsed config for %q, got %+v", otherPath, cfg3)
+	}
+}
@@ -1,12 +1,14 @@
 package util
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 
 	"github.com/containers/buildah/define"
+	"github.com/containers/buildah/internal/mkcw"
 	"github.com/containers/common/libimage"
 	"github.com/containers/image/v5/types"
 	encconfig "github.com/containers/ocicrypt/config"
@@ -68,6 +70,9 @@ func ExportFromReader(input io.Reader, opts define.BuildOutputOption) error {
 			return err
 		}
 	}
+	if opts.ConfidentialWorkload != nil {
+		return ExportEncryptedWorkload(input, opts)
+	}
 	if opts.IsDir {
 		// In order to keep this feature as close as possible to
 		// buildkit it was decided to preserve ownership when
@@ -86,6 +91,12 @@ func ExportFromReader(input io.Reader, opts define.BuildOutputOption) error {
 			return fmt.Errorf("failed while creating the destination path %q: %w", opts.Path, err)
 		}
 
+		if opts.Encrypted != nil {
+			if err := provisionFscryptPolicy(opts.Path, opts.Encrypted); err != nil {
+				return fmt.Errorf("failed while provisioning fscrypt policy on %q: %w", opts.Path, err)
+			}
+		}
+
 		err = chrootarchive.Untar(input, opts.Path, &archive.TarOptions{NoLchown: noLChown})
 		if err != nil {
 			return fmt.Errorf("failed while performing untar at %q: %w", opts.Path, err)
@@ -99,7 +110,7 @@ func ExportFromReader(input io.Reader, opts define.BuildOutputOption) error {
 			}
 			defer outFile.Close()
 		}
-		_, err = io.Copy(outFile, input)
+		err = writeCompressedOutput(input, outFile, opts)
 		if err != nil {
 			return fmt.Errorf("failed while performing copy to %q: %w", opts.Path, err)
 		}
@@ -107,10 +118,79 @@ func ExportFromReader(input io.Reader, opts define.BuildOutputOption) error {
 	return nil
 }
 
-// DecryptConfig translates decryptionKeys into a DescriptionConfig structure
-func DecryptConfig(decryptionKeys []string) (*encconfig.DecryptConfig, error) {
+// ExportEncryptedWorkload packages the tar stream read from input as an
+// encrypted confidential-computing workload image instead of a plain rootfs
+// or tar archive, per opts.ConfidentialWorkload. The output written at
+// opts.Path is the LUKS2-encrypted filesystem image; the WorkloadConfig
+// describing it is registered with the attestation server and, if the
+// caller provided a non-nil opts.ConfidentialWorkload.Annotations map,
+// left there under mkcw.WorkloadConfigAnnotation for the image builder to
+// carry forward as an OCI image config annotation.
+func ExportEncryptedWorkload(input io.Reader, opts define.BuildOutputOption) error {
+	cw := opts.ConfidentialWorkload
+	// Build the intermediate filesystem image on the same filesystem as
+	// the final destination, so the rename below is a same-filesystem
+	// rename rather than one that can fail with EXDEV (e.g. a tmpfs
+	// $TMPDIR against an on-disk output path).
+	fsImage, workloadConfig, passphrase, err := mkcw.Archive(input, func(r io.Reader, dest string) error {
+		return chrootarchive.Untar(r, dest, &archive.TarOptions{})
+	}, mkcw.ArchiveOptions{
+		TeeType:                  cw.TeeType,
+		AttestationURL:           cw.AttestationURL,
+		DiskEncryptionPassphrase: cw.DiskEncryptionPassphrase,
+		CPUs:                     cw.CPUs,
+		Memory:                   cw.Memory,
+		WorkDir:                  filepath.Dir(opts.Path),
+	})
+	if err != nil {
+		return fmt.Errorf("building confidential workload image: %w", err)
+	}
+	defer os.Remove(fsImage)
+
+	if err := os.Rename(fsImage, opts.Path); err != nil {
+		return fmt.Errorf("moving confidential workload image to %q: %w", opts.Path, err)
+	}
+
+	measurement, err := mkcw.ComputeLaunchMeasurement(opts.Path)
+	if err != nil {
+		return err
+	}
+	if err := mkcw.RegisterWorkload(workloadConfig, passphrase, measurement); err != nil {
+		return fmt.Errorf("registering confidential workload before push: %w", err)
+	}
+
+	if cw.Annotations != nil {
+		encoded, err := json.Marshal(workloadConfig)
+		if err != nil {
+			return fmt.Errorf("encoding %s: %w", mkcw.WorkloadConfigAnnotation, err)
+		}
+		cw.Annotations[mkcw.WorkloadConfigAnnotation] = string(encoded)
+	}
+
+	return nil
+}
+
+// DecryptConfig translates decryptionKeys into a DescriptionConfig
+// structure. decryptionKeys may, in addition to the jwe/pgp/pkcs7 key
+// strings CreateCryptoConfig already understands, contain
+// "provider:<name>[:<attrs>]" keyprovider specs (resolved against
+// keyProviderConfigPath, falling back to OCICRYPT_KEYPROVIDER_CONFIG if
+// empty) and "pkcs11:<uri-or-yaml-path>" HSM key specs (each checked to
+// name a pkcs11 URI; pkcs11ConfigPath, if set, is parsed but the keys are
+// not checked against it).
+func DecryptConfig(decryptionKeys []string, keyProviderConfigPath, pkcs11ConfigPath string) (*encconfig.DecryptConfig, error) {
 	decryptConfig := &encconfig.DecryptConfig{}
 	if len(decryptionKeys) > 0 {
+		if err := registerKeyProviders(decryptionKeys, keyProviderConfigPath); err != nil {
+			return nil, err
+		}
+		decryptionKeys, cleanup, err := resolvePkcs11Keys(decryptionKeys, pkcs11ConfigPath)
+		if cleanup != nil {
+			defer cleanup()
+		}
+		if err != nil {
+			return nil, err
+		}
 		// decryption
 		dcc, err := enchelpers.CreateCryptoConfig([]string{}, decryptionKeys)
 		if err != nil {
@@ -123,12 +203,29 @@ func DecryptConfig(decryptionKeys []string) (*encconfig.DecryptConfig, error) {
 	return decryptConfig, nil
 }
 
-// EncryptConfig translates encryptionKeys into a EncriptionsConfig structure
-func EncryptConfig(encryptionKeys []string, encryptLayers []int) (*encconfig.EncryptConfig, *[]int, error) {
+// EncryptConfig translates encryptionKeys into a EncriptionsConfig
+// structure. encryptionKeys may, in addition to the jwe/pgp/pkcs7 key
+// strings CreateCryptoConfig already understands, contain
+// "provider:<name>[:<attrs>]" keyprovider specs (resolved against
+// keyProviderConfigPath, falling back to OCICRYPT_KEYPROVIDER_CONFIG if
+// empty) and "pkcs11:<uri-or-yaml-path>" HSM key specs (each checked to
+// name a pkcs11 URI; pkcs11ConfigPath, if set, is parsed but the keys are
+// not checked against it).
+func EncryptConfig(encryptionKeys []string, encryptLayers []int, keyProviderConfigPath, pkcs11ConfigPath string) (*encconfig.EncryptConfig, *[]int, error) {
 	var encLayers *[]int
 	var encConfig *encconfig.EncryptConfig
 
 	if len(encryptionKeys) > 0 {
+		if err := registerKeyProviders(encryptionKeys, keyProviderConfigPath); err != nil {
+			return nil, nil, err
+		}
+		encryptionKeys, cleanup, err := resolvePkcs11Keys(encryptionKeys, pkcs11ConfigPath)
+		if cleanup != nil {
+			defer cleanup()
+		}
+		if err != nil {
+			return nil, nil, err
+		}
 		// encryption
 		encLayers = &encryptLayers
 		ecc, err := enchelpers.CreateCryptoConfig(encryptionKeys, []string{})
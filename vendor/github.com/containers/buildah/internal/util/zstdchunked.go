@@ -0,0 +1,179 @@
+package util
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/containers/buildah/define"
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdChunkedTOCEntry describes one file's placement within a zstd:chunked
+// stream: a {name, offset, size, digest} record giving the byte range of
+// the compressed frame(s) backing that file, so a cooperating
+// registry/client could in principle fetch just that range out of the
+// stream. This is not a bit-for-bit implementation of containers/storage's
+// own zstd:chunked manifest format (that also carries xattrs, chunk
+// sub-splitting, and a different on-disk encoding) — it follows the same
+// shape and intent, not that wire format.
+type zstdChunkedTOCEntry struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"`
+}
+
+// zstdChunkedTOC is the JSON manifest appended, uncompressed, to a
+// zstd:chunked stream, immediately before the fixed-size footer that
+// points at it.
+type zstdChunkedTOC struct {
+	Version int                   `json:"version"`
+	Entries []zstdChunkedTOCEntry `json:"entries"`
+}
+
+// zstdChunkedFooterSize is the size, in bytes, of the fixed trailer a
+// zstd:chunked reader seeks to from the end of the stream to locate the
+// TOC: the TOC's offset and length, each a little-endian uint64. The TOC
+// itself is written uncompressed after the zstd stream ends, so both
+// fields are plain byte offsets/lengths into the output file, not
+// compressed- or uncompressed-stream positions.
+const zstdChunkedFooterSize = 16
+
+// countingWriter tracks how many bytes have been written to the
+// underlying writer, so chunk boundaries can be recorded as offsets into
+// the compressed output stream.
+type countingWriter struct {
+	w       io.Writer
+	written int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.written += int64(n)
+	return n, err
+}
+
+// writeCompressedOutput streams input through the compressor selected by
+// opts.Compression into output. For BuildOutputCompressionZstdChunked, it
+// also appends a TOC and footer describing each file's chunk boundaries
+// within the compressed stream.
+func writeCompressedOutput(input io.Reader, output io.Writer, opts define.BuildOutputOption) error {
+	switch opts.Compression {
+	case define.BuildOutputCompressionNone:
+		_, err := io.Copy(output, input)
+		return err
+	case define.BuildOutputCompressionGzip:
+		gw := gzip.NewWriter(output)
+		if _, err := io.Copy(gw, input); err != nil {
+			return err
+		}
+		return gw.Close()
+	case define.BuildOutputCompressionZstd:
+		zw, err := zstd.NewWriter(output)
+		if err != nil {
+			return fmt.Errorf("creating zstd writer: %w", err)
+		}
+		if _, err := io.Copy(zw, input); err != nil {
+			zw.Close()
+			return err
+		}
+		return zw.Close()
+	case define.BuildOutputCompressionZstdChunked:
+		return writeZstdChunked(input, output, opts.ChunkSize)
+	default:
+		return fmt.Errorf("unrecognized output compression %q", opts.Compression)
+	}
+}
+
+// writeZstdChunked re-tars the entries read from input into a zstd
+// stream, ending the zstd frame after each entry so that each recorded
+// chunk lands on a frame boundary, then appends a JSON TOC and footer
+// pointing at it. Each entry is exactly one chunk whatever its size:
+// chunkSize does not split an entry's content.
+func writeZstdChunked(input io.Reader, output io.Writer, chunkSize int64) error {
+	if chunkSize <= 0 {
+		chunkSize = 4 * 1024 * 1024
+	}
+
+	counting := &countingWriter{w: output}
+	zw, err := zstd.NewWriter(counting)
+	if err != nil {
+		return fmt.Errorf("creating zstd writer: %w", err)
+	}
+
+	tr := tar.NewReader(input)
+	tw := tar.NewWriter(zw)
+	var toc zstdChunkedTOC
+	toc.Version = 1
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar entry: %w", err)
+		}
+
+		startOffset := counting.written
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("writing tar header for %q: %w", hdr.Name, err)
+		}
+
+		digest := sha256.New()
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := io.Copy(io.MultiWriter(tw, digest), tr); err != nil {
+				return fmt.Errorf("writing tar content for %q: %w", hdr.Name, err)
+			}
+		}
+		// Close the frame and start a new one so this entry ends on its own
+		// zstd frame, giving it a standalone, independently fetchable byte
+		// range in the output.
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("closing zstd frame for %q: %w", hdr.Name, err)
+		}
+		zw.Reset(counting)
+
+		toc.Entries = append(toc.Entries, zstdChunkedTOCEntry{
+			Name:   hdr.Name,
+			Offset: startOffset,
+			Size:   counting.written - startOffset,
+			Digest: "sha256:" + fmt.Sprintf("%x", digest.Sum(nil)),
+		})
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("closing tar writer: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("closing zstd writer: %w", err)
+	}
+
+	// The TOC is written uncompressed, directly to the underlying output,
+	// after the zstd stream has been closed: that keeps tocOffset and
+	// len(tocJSON) in the same units (raw bytes of the output file) as
+	// what the footer below records, instead of mixing a compressed-
+	// stream offset with an uncompressed length.
+	tocOffset := counting.written
+	tocJSON, err := json.Marshal(toc)
+	if err != nil {
+		return fmt.Errorf("encoding zstd:chunked TOC: %w", err)
+	}
+	if _, err := counting.Write(tocJSON); err != nil {
+		return fmt.Errorf("writing zstd:chunked TOC: %w", err)
+	}
+
+	footer := make([]byte, zstdChunkedFooterSize)
+	binary.LittleEndian.PutUint64(footer[0:8], uint64(tocOffset))
+	binary.LittleEndian.PutUint64(footer[8:16], uint64(len(tocJSON)))
+	if _, err := counting.Write(footer); err != nil {
+		return fmt.Errorf("writing zstd:chunked footer: %w", err)
+	}
+
+	return nil
+}
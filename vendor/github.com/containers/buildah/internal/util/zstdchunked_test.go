@@ -0,0 +1,121 @@
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestWriteZstdChunkedRoundTrip(t *testing.T) {
+	type file struct {
+		name string
+		body string
+	}
+	files := []file{
+		{"a.txt", "hello from file a"},
+		{"dir/b.txt", "hello from file b, which is a bit longer than a"},
+		{"empty.txt", ""},
+	}
+
+	var tarInput bytes.Buffer
+	tw := tar.NewWriter(&tarInput)
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     f.name,
+			Typeflag: tar.TypeReg,
+			Size:     int64(len(f.body)),
+			Mode:     0o644,
+		}); err != nil {
+			t.Fatalf("writing tar header for %q: %v", f.name, err)
+		}
+		if _, err := tw.Write([]byte(f.body)); err != nil {
+			t.Fatalf("writing tar content for %q: %v", f.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("closing tar input: %v", err)
+	}
+
+	var output bytes.Buffer
+	if err := writeZstdChunked(&tarInput, &output, 0); err != nil {
+		t.Fatalf("writeZstdChunked: %v", err)
+	}
+	out := output.Bytes()
+
+	if len(out) < zstdChunkedFooterSize {
+		t.Fatalf("output too short to contain a footer: %d bytes", len(out))
+	}
+	footer := out[len(out)-zstdChunkedFooterSize:]
+	tocOffset := binary.LittleEndian.Uint64(footer[0:8])
+	tocLength := binary.LittleEndian.Uint64(footer[8:16])
+
+	if tocOffset+tocLength > uint64(len(out)-zstdChunkedFooterSize) {
+		t.Fatalf("TOC range [%d, %d) runs past the footer at %d", tocOffset, tocOffset+tocLength, len(out)-zstdChunkedFooterSize)
+	}
+
+	var toc zstdChunkedTOC
+	if err := json.Unmarshal(out[tocOffset:tocOffset+tocLength], &toc); err != nil {
+		t.Fatalf("parsing TOC: %v", err)
+	}
+	if len(toc.Entries) != len(files) {
+		t.Fatalf("TOC has %d entries, want %d", len(toc.Entries), len(files))
+	}
+
+	// The compressed zstd stream precedes the TOC; decompressing it
+	// should reproduce the original tar stream's entries and content.
+	zr, err := zstd.NewReader(bytes.NewReader(out[:tocOffset]))
+	if err != nil {
+		t.Fatalf("creating zstd reader: %v", err)
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	got := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading decompressed tar entry: %v", err)
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("reading decompressed tar content for %q: %v", hdr.Name, err)
+		}
+		got[hdr.Name] = string(body)
+	}
+	for _, f := range files {
+		if got[f.name] != f.body {
+			t.Errorf("decompressed content for %q = %q, want %q", f.name, got[f.name], f.body)
+		}
+	}
+
+	// Each TOC entry's offset/size must address a valid range within the
+	// compressed stream portion of the output, and its digest must match
+	// the corresponding file's content.
+	want := map[string]string{}
+	for _, f := range files {
+		want[f.name] = f.body
+	}
+	for _, entry := range toc.Entries {
+		if entry.Offset < 0 || entry.Size < 0 || uint64(entry.Offset+entry.Size) > tocOffset {
+			t.Errorf("TOC entry %q range [%d, %d) runs outside the compressed stream (length %d)", entry.Name, entry.Offset, entry.Offset+entry.Size, tocOffset)
+		}
+		body, ok := want[entry.Name]
+		if !ok {
+			t.Errorf("TOC entry %q does not correspond to an input file", entry.Name)
+			continue
+		}
+		wantDigest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(body)))
+		if entry.Digest != wantDigest {
+			t.Errorf("TOC entry %q digest = %q, want %q", entry.Name, entry.Digest, wantDigest)
+		}
+	}
+}